@@ -0,0 +1,146 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a single cached upstream response. It stays fresh for ttl
+// after createdAt, and remains servable stale (stale-while-revalidate) for
+// a further staleWindow after that, so a burst of clients asking about the
+// same domain during upstream flakiness gets a slightly stale answer
+// instead of "Upstream query failed".
+type cacheEntry struct {
+	key       string
+	body      []byte
+	negative  bool
+	createdAt time.Time
+	ttl       time.Duration
+
+	element *list.Element
+}
+
+func (e *cacheEntry) fresh() bool {
+	return time.Since(e.createdAt) <= e.ttl
+}
+
+// staleWindow is how much longer, past ttl, an entry may still be served
+// while a fresh answer is fetched in the background.
+const staleWindow = 30 * time.Second
+
+func (e *cacheEntry) expired() bool {
+	return time.Since(e.createdAt) > e.ttl+staleWindow
+}
+
+// responseCache is a concurrent-safe, size-bounded LRU cache of upstream
+// responses, keyed by the normalized query string. Positive and negative
+// (no-match) answers carry their own TTLs.
+type responseCache struct {
+	mu    sync.Mutex
+	byKey map[string]*cacheEntry
+	lru   *list.List
+
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+func newResponseCache(size int, ttl, negativeTTL time.Duration) *responseCache {
+	return &responseCache{
+		byKey:       make(map[string]*cacheEntry),
+		lru:         list.New(),
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// get returns the cached entry for key, if any, and whether it is still
+// fresh. A stale-but-not-expired entry is returned with fresh=false so the
+// caller can serve it while revalidating.
+func (c *responseCache) get(key string) (entry cacheEntry, fresh bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.byKey[key]
+	if !found || e.expired() {
+		return cacheEntry{}, false, false
+	}
+
+	c.lru.MoveToFront(e.element)
+
+	return *e, e.fresh(), true
+}
+
+// set stores body under key, marking it negative (a no-match/not-found
+// answer) if appropriate, and evicts the least-recently-used entry if the
+// cache is over capacity.
+func (c *responseCache) set(key string, body []byte, negative bool) {
+	if c.size <= 0 {
+		return
+	}
+
+	ttl := c.ttl
+	if negative {
+		ttl = c.negativeTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, found := c.byKey[key]; found {
+		existing.body = body
+		existing.negative = negative
+		existing.createdAt = time.Now()
+		existing.ttl = ttl
+		c.lru.MoveToFront(existing.element)
+		return
+	}
+
+	e := &cacheEntry{key: key, body: body, negative: negative, createdAt: time.Now(), ttl: ttl}
+	e.element = c.lru.PushFront(e)
+	c.byKey[key] = e
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+
+		c.lru.Remove(oldest)
+		delete(c.byKey, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// sweep removes fully-expired entries. It runs periodically for the
+// lifetime of the server so memory doesn't grow unbounded with cold keys
+// that are never looked up again (and thus never hit the expired() check
+// in get).
+func (c *responseCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.byKey {
+		if e.expired() {
+			c.lru.Remove(e.element)
+			delete(c.byKey, key)
+		}
+	}
+}
+
+// runSweeper periodically sweeps the cache until stop is closed or
+// signaled.
+func (c *responseCache) runSweeper(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-stop:
+			return
+		}
+	}
+}
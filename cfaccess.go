@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// cfAccess injects Cloudflare Access (or any generic OIDC client-credentials
+// provider) authentication into upstream requests. With clientID/clientSecret
+// set alone, it sends them as CF-Access-Client-Id/CF-Access-Client-Secret
+// service-token headers. With tokenURL also set, it instead fetches a bearer
+// JWT from tokenURL using those as client credentials and caches it. A new
+// token is fetched by the first request made within 30 seconds of the cached
+// token's expiry (or after it); no background goroutine refreshes it, so
+// that request waits for the fetch.
+type cfAccess struct {
+	clientID     string
+	clientSecret string
+	tokenURL     string
+
+	client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newCFAccess(clientID, clientSecret, tokenURL string) *cfAccess {
+	return &cfAccess{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		tokenURL:     tokenURL,
+		client:       &http.Client{},
+	}
+}
+
+// applyTo adds the configured credentials to req, fetching/refreshing a
+// bearer token first if a token endpoint is configured.
+func (c *cfAccess) applyTo(req *http.Request) error {
+	if c.tokenURL == "" {
+		req.Header.Set("CF-Access-Client-Id", c.clientID)
+		req.Header.Set("CF-Access-Client-Secret", c.clientSecret)
+		return nil
+	}
+
+	token, err := c.currentToken()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
+
+// invalidate drops any cached token so the next request fetches a fresh
+// one. Called after the upstream rejects a request with 401/403.
+func (c *cfAccess) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = ""
+	c.expiresAt = time.Time{}
+}
+
+func (c *cfAccess) currentToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expiresAt) {
+		return c.token, nil
+	}
+
+	token, expiresIn, err := c.fetchToken()
+	if err != nil {
+		return "", err
+	}
+
+	c.token = token
+	c.expiresAt = time.Now().Add(expiresIn)
+
+	return c.token, nil
+}
+
+// tokenResponse is the relevant subset of a standard OAuth2
+// client-credentials token response.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (c *cfAccess) fetchToken() (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", c.clientID)
+	form.Set("client_secret", c.clientSecret)
+
+	resp, err := c.client.PostForm(c.tokenURL, form)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to fetch cf-access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", 0, fmt.Errorf("cf-access token endpoint returned status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read cf-access token response: %w", err)
+	}
+
+	var parsed tokenResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", 0, fmt.Errorf("failed to parse cf-access token response: %w", err)
+	}
+
+	if parsed.AccessToken == "" {
+		return "", 0, fmt.Errorf("cf-access token response missing access_token")
+	}
+
+	expiresIn := time.Duration(parsed.ExpiresIn) * time.Second
+	// Refresh a little early so a concurrent handler never sees a token
+	// that expires mid-request.
+	const earlyRefresh = 30 * time.Second
+	if expiresIn > earlyRefresh {
+		expiresIn -= earlyRefresh
+	}
+
+	return parsed.AccessToken, expiresIn, nil
+}
+
+// doUpstream performs req against upstream, applying Cloudflare Access
+// credentials if configured and retrying once, with the cached token
+// invalidated, if the upstream responds 401/403.
+func (s *WhoisServer) doUpstream(client *http.Client, req *http.Request) (*http.Response, error) {
+	if s.cfAccess == nil {
+		return client.Do(req)
+	}
+
+	if err := s.cfAccess.applyTo(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	s.cfAccess.invalidate()
+
+	retry := req.Clone(req.Context())
+
+	if err := s.cfAccess.applyTo(retry); err != nil {
+		return nil, err
+	}
+
+	return client.Do(retry)
+}
@@ -0,0 +1,174 @@
+// Package idna implements just enough of IDNA 2008 (RFC 5891) and the
+// punycode algorithm (RFC 3492) to turn internationalized domain name
+// labels into their ASCII "xn--" encoded form, without depending on
+// golang.org/x/net/idna.
+package idna
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	base        = 36
+	tmin        = 1
+	tmax        = 26
+	skew        = 38
+	damp        = 700
+	initialBias = 72
+	initialN    = 128
+	delimiter   = '-'
+	acePrefix   = "xn--"
+)
+
+// ToASCII lowercases domain and encodes each non-ASCII label using
+// punycode, leaving already-ASCII labels untouched. A trailing dot, if
+// present, is preserved.
+func ToASCII(domain string) (string, error) {
+	domain = strings.ToLower(domain)
+
+	trailingDot := strings.HasSuffix(domain, ".")
+	domain = strings.TrimSuffix(domain, ".")
+
+	labels := strings.Split(domain, ".")
+
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+
+		encoded, err := encodeLabel(label)
+		if err != nil {
+			return "", fmt.Errorf("idna: failed to encode label %q: %w", label, err)
+		}
+
+		labels[i] = acePrefix + encoded
+	}
+
+	result := strings.Join(labels, ".")
+	if trailingDot {
+		result += "."
+	}
+
+	return result, nil
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeLabel punycode-encodes a single label's code points per RFC 3492.
+func encodeLabel(label string) (string, error) {
+	runes := []rune(label)
+
+	var output []rune
+	var basicCount int
+
+	for _, r := range runes {
+		if r < initialN {
+			output = append(output, r)
+			basicCount++
+		}
+	}
+
+	handled := basicCount
+	n := initialN
+	bias := initialBias
+	delta := 0
+
+	if basicCount > 0 {
+		output = append(output, delimiter)
+	}
+
+	for handled < len(runes) {
+		m := nextCodePoint(runes, n)
+
+		delta += (m - n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+
+			if int(r) == n {
+				q := delta
+
+				for k := base; ; k += base {
+					t := threshold(k, bias)
+
+					if q < t {
+						output = append(output, digitToBasic(q))
+						break
+					}
+
+					output = append(output, digitToBasic(t+(q-t)%(base-t)))
+					q = (q - t) / (base - t)
+				}
+
+				bias = adapt(delta, handled+1, handled == basicCount)
+				delta = 0
+				handled++
+			}
+		}
+
+		delta++
+		n++
+	}
+
+	return string(output), nil
+}
+
+func nextCodePoint(runes []rune, from int) int {
+	m := int(^uint(0) >> 1)
+
+	for _, r := range runes {
+		if int(r) >= from && int(r) < m {
+			m = int(r)
+		}
+	}
+
+	return m
+}
+
+func threshold(k, bias int) int {
+	switch {
+	case k <= bias+tmin:
+		return tmin
+	case k >= bias+tmax:
+		return tmax
+	default:
+		return k - bias
+	}
+}
+
+func digitToBasic(digit int) rune {
+	if digit < 26 {
+		return rune('a' + digit)
+	}
+	return rune('0' + digit - 26)
+}
+
+// adapt implements the bias adaptation function from RFC 3492 section 6.1.
+func adapt(delta, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((base-tmin)*tmax)/2 {
+		delta /= base - tmin
+		k += base
+	}
+
+	return k + (base-tmin+1)*delta/(delta+skew)
+}
@@ -0,0 +1,35 @@
+package idna
+
+import "testing"
+
+func TestToASCII(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"already ascii", "example.com", "example.com"},
+		{"mixed case ascii is lowercased", "Example.COM", "example.com"},
+		{"german umlaut", "bücher.de", "xn--bcher-kva.de"},
+		{"german eszett", "straße.de", "xn--strae-oqa.de"},
+		{"french accent", "café.fr", "xn--caf-dma.fr"},
+		{"japanese", "例え.jp", "xn--r8jz45g.jp"},
+		{"chinese, no ascii labels at all", "他们为什么不说中文", "xn--ihqwcrb4cv8a8dqg056pqjye"},
+		{"every label encoded", "пример.рф", "xn--e1afmkfd.xn--p1ai"},
+		{"trailing dot is preserved", "straße.de.", "xn--strae-oqa.de."},
+		{"only one of several labels needs encoding", "www.bücher.de", "www.xn--bcher-kva.de"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ToASCII(c.in)
+			if err != nil {
+				t.Fatalf("ToASCII(%q) returned error: %v", c.in, err)
+			}
+
+			if got != c.want {
+				t.Errorf("ToASCII(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
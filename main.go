@@ -19,6 +19,7 @@ import (
 )
 
 import (
+	"github.com/davidrjonas/whois2http/internal/idna"
 	"github.com/ulule/limiter"
 	"github.com/ulule/limiter/drivers/store/memory"
 )
@@ -27,11 +28,40 @@ var (
 	listen                        = flag.String("listen", ":43", "target")
 	upstream                      = flag.String("upstream", "http://example.com:80/whois?format=plain&query={{query}}", "Upstream to which we should proxy")
 	rate                          = flag.String("rate", "3-M", "Rate at which requests can be made in the format <count>-<period> where count is an integer and period is one of S, M, H for second, minute, or hour.")
+	protocol                      = flag.String("protocol", "", "Upstream protocol: 'whois-http' or 'rdap'. If unset, it is guessed from the upstream URL.")
+	followReferrals               = flag.Bool("follow-referrals", false, "Follow 'Registrar WHOIS Server:' referrals (thin-registry TLDs like .com/.net) over raw WHOIS.")
+	maxReferralHops               = flag.Int("max-referral-hops", 2, "Maximum number of referrals to follow per query.")
+	referralTimeout               = flag.Duration("referral-timeout", 5*time.Second, "Timeout for each referral WHOIS query.")
+	cfAccessClientID              = flag.String("cf-access-client-id", "", "Cloudflare Access service token client ID to send with every upstream request.")
+	cfAccessClientSecret          = flag.String("cf-access-client-secret", "", "Cloudflare Access service token client secret to send with every upstream request.")
+	cfAccessTokenURL              = flag.String("cf-access-token-url", "", "OIDC token endpoint to exchange the client id/secret for a bearer JWT, refreshed before it expires. If unset, the client id/secret are sent directly as CF-Access-Client-Id/CF-Access-Client-Secret headers.")
+	ipv4Prefix                    = flag.Int("ipv4-prefix", 32, "Number of leading bits of a client's IPv4 address used as its rate-limit key.")
+	ipv6Prefix                    = flag.Int("ipv6-prefix", 64, "Number of leading bits of a client's IPv6 address used as its rate-limit key.")
+	cacheSize                     = flag.Int("cache-size", 0, "Maximum number of responses to cache, keyed by normalized query. 0 disables the cache.")
+	cacheTTL                      = flag.Duration("cache-ttl", time.Minute, "How long a positive (match) response stays cached.")
+	cacheNegativeTTL              = flag.Duration("cache-negative-ttl", time.Minute, "How long a negative (no-match) response stays cached.")
+	cacheChargeOnHit              = flag.Bool("cache-charge-on-hit", false, "Still charge the rate limiter on a cache hit, instead of skipping it.")
 	commandPattern, _             = regexp.Compile("^[a-zA-Z0-9][a-zA-Z0-9-]{0,61}[a-zA-Z0-9]\\.[a-zA-Z]{2,}\\.?$")
 	translateLineEndingPattern, _ = regexp.Compile("([^\r])\n")
 	headerSplitPattern, _         = regexp.Compile(":\\s*")
 )
 
+const (
+	protocolWhoisHTTP = "whois-http"
+	protocolRDAP      = "rdap"
+)
+
+// detectProtocol guesses the upstream protocol from its URL when -protocol
+// is left unset, since most operators only ever point at one kind of
+// upstream and an RDAP endpoint is recognizable by convention.
+func detectProtocol(upstream *url.URL) string {
+	if strings.Contains(upstream.Host, "rdap") || strings.Contains(upstream.Path, "rdap") {
+		return protocolRDAP
+	}
+
+	return protocolWhoisHTTP
+}
+
 type header struct {
 	name  string
 	value string
@@ -77,12 +107,28 @@ func mustListen(laddr string) *net.TCPListener {
 }
 
 type WhoisServer struct {
-	upstream      *url.URL
-	acceptTimeout time.Duration
-	headers       []header
-	limiter       *limiter.Limiter
-	stop          chan bool
-	done          chan bool
+	upstreamTemplate string
+	protocol         string
+	acceptTimeout    time.Duration
+	headers          []header
+	limiter          *limiter.Limiter
+	rdapBootstrap    *rdapBootstrapCache
+	cfAccess         *cfAccess
+
+	maxReferralHops   int
+	referralTimeout   time.Duration
+	referralAllowList []string
+
+	ipv4Prefix int
+	ipv6Prefix int
+
+	routes []route
+
+	cache            *responseCache
+	cacheChargeOnHit bool
+
+	stop chan bool
+	done chan bool
 }
 
 type Handler func(net.Conn) error
@@ -98,7 +144,7 @@ func parseUpstreamOpt(opt_val string) *url.URL {
 }
 
 func (s *WhoisServer) Stop() {
-	s.stop <- true
+	close(s.stop)
 	<-s.done
 }
 
@@ -143,10 +189,14 @@ OUTER:
 
 func (s *WhoisServer) shouldLimit(remoteAddr string) bool {
 
-	ip := remoteAddr[0:strings.LastIndex(remoteAddr, ":")]
+	ip, err := rateLimitKey(remoteAddr, s.ipv4Prefix, s.ipv6Prefix)
+	if err != nil {
+		log.Printf("error computing rate limit key; remoteAddr=%s, error=%v", remoteAddr, err)
+		return false
+	}
+
 	ctx := context.Background()
 
-	var err error
 	var lctx limiter.Context
 
 	if lctx, err = s.limiter.Get(ctx, ip); err != nil {
@@ -162,31 +212,34 @@ func (s *WhoisServer) shouldLimit(remoteAddr string) bool {
 	return lctx.Reached
 }
 
-func (s *WhoisServer) handler(conn net.Conn) error {
-	if s.shouldLimit(conn.RemoteAddr().String()) {
-		conn.Write([]byte("Rate limited\r\n"))
-		return nil
-	}
+// fetchError carries the client-facing message a failed fetch should
+// result in, alongside the underlying error for logging.
+type fetchError struct {
+	msg string
+	err error
+}
 
-	buf := bufio.NewReader(conn)
-	domain, err := buf.ReadString('\n')
-	if err != nil {
-		return err
-	}
+func (e *fetchError) Error() string { return e.err.Error() }
+func (e *fetchError) Unwrap() error { return e.err }
 
-	domain = strings.TrimRight(domain, "\r\n")
+// fetch performs the actual upstream lookup for domain, dispatching on
+// protocol, and returns the rendered response text along with whether it is
+// a negative (no-match) answer. It does not touch conn so it can also be
+// used to revalidate a stale cache entry in the background.
+func (s *WhoisServer) fetch(domain string) (text string, negative bool, err error) {
+	template, protocol := s.resolveRoute(domain)
 
-	log.Printf("recevied query; query=%v, ip=%v", domain, conn.RemoteAddr().String())
+	if protocol == protocolRDAP {
+		text, negative, err = s.queryRDAP(domain, template)
+		if err != nil {
+			return "", false, &fetchError{msg: "Upstream query failed\r\n", err: err}
+		}
 
-	// Validate
-	if !commandPattern.MatchString(domain) {
-		log.Println("query did not match pattern")
-		conn.Write([]byte("Invalid query\r\n"))
-		return nil
+		return text, negative, nil
 	}
 
 	// Query backend
-	url := strings.Replace(*upstream, "{{query}}", url.QueryEscape(domain), -1)
+	url := strings.Replace(template, "{{query}}", url.QueryEscape(domain), -1)
 
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
@@ -205,27 +258,139 @@ func (s *WhoisServer) handler(conn net.Conn) error {
 		req.Header.Add(h.name, h.value)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := s.doUpstream(client, req)
 	if err != nil {
-		conn.Write([]byte("Upstream query failed\r\n"))
-		return err
+		return "", false, &fetchError{msg: "Upstream query failed\r\n", err: err}
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		conn.Write([]byte("Invalid query\r\n"))
-		return fmt.Errorf("Response is not 200; code=%d", resp.StatusCode)
+		return "", false, &fetchError{msg: "Invalid query\r\n", err: fmt.Errorf("Response is not 200; code=%d", resp.StatusCode)}
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		conn.Write([]byte("Error reading upstream body\r\n"))
-		return err
+		return "", false, &fetchError{msg: "Error reading upstream body\r\n", err: err}
 	}
 
-	conn.Write(translateLineEndingPattern.ReplaceAll(body, []byte("$1\r\n")))
+	body = s.chaseReferrals(domain, body)
+
+	return string(body), false, nil
+}
+
+// revalidate re-fetches domain in the background to refresh a stale cache
+// entry. Failures are logged and otherwise ignored, leaving the stale
+// entry in place until it fully expires.
+func (s *WhoisServer) revalidate(domain string) {
+	text, negative, err := s.fetch(domain)
+	if err != nil {
+		log.Printf("cache revalidation failed, serving stale; domain=%s, err=%v", domain, err)
+		return
+	}
+
+	s.cache.set(domain, []byte(text), negative)
+}
+
+func (s *WhoisServer) writeResponse(conn net.Conn, text string) {
+	conn.Write(translateLineEndingPattern.ReplaceAll([]byte(text), []byte("$1\r\n")))
 	conn.Write([]byte("\r\n"))
+}
+
+// cachedFresh reports whether domain (the normalized, IDNA-encoded form —
+// the same key entries are stored and looked up under elsewhere) has a
+// fresh, servable-without-charge cache entry, without itself touching the
+// rate limiter.
+func (s *WhoisServer) cachedFresh(domain string) (entry cacheEntry, ok bool) {
+	if s.cache == nil || s.cacheChargeOnHit {
+		return cacheEntry{}, false
+	}
+
+	entry, fresh, ok := s.cache.get(domain)
+
+	return entry, ok && fresh
+}
+
+func (s *WhoisServer) handler(conn net.Conn) error {
+	buf := bufio.NewReader(conn)
+	domain, err := buf.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	domain = strings.TrimRight(domain, "\r\n")
+
+	// Encode before the rate-limit check below: cachedFresh must be asked
+	// about the same normalized key the cache is actually stored under, or
+	// it'll always miss for mixed-case/trailing-dot/IDN queries and charge
+	// the limiter for lookups the cache is already answering for free. An
+	// encoding failure doesn't give us a key to check, but the query still
+	// has to be charged, so it falls through to the unconditional
+	// shouldLimit below same as any other query.
+	encoded, idnaErr := idna.ToASCII(domain)
+
+	// A cache hit may skip the rate-limiter charge entirely, per
+	// -cache-charge-on-hit; everything else, including malformed queries,
+	// is gated here before any further parsing or validation runs.
+	hit := false
+	if idnaErr == nil {
+		_, hit = s.cachedFresh(encoded)
+	}
+
+	if !hit {
+		if s.shouldLimit(conn.RemoteAddr().String()) {
+			conn.Write([]byte("Rate limited\r\n"))
+			return nil
+		}
+	}
+
+	if idnaErr != nil {
+		log.Printf("failed to encode query as idna; query=%v, err=%v", domain, idnaErr)
+		conn.Write([]byte("Invalid query\r\n"))
+		return nil
+	}
+
+	log.Printf("recevied query; query=%v, encoded=%v, ip=%v", domain, encoded, conn.RemoteAddr().String())
+
+	domain = encoded
+
+	// Validate
+	if !commandPattern.MatchString(domain) {
+		log.Println("query did not match pattern")
+		conn.Write([]byte("Invalid query\r\n"))
+		return nil
+	}
+
+	if s.cache != nil {
+		if entry, fresh, ok := s.cache.get(domain); ok {
+			if !fresh {
+				go s.revalidate(domain)
+			}
+
+			s.writeResponse(conn, string(entry.body))
+
+			return nil
+		}
+	}
+
+	text, negative, err := s.fetch(domain)
+	if err != nil {
+		msg := "Upstream query failed\r\n"
+		if ferr, ok := err.(*fetchError); ok {
+			msg = ferr.msg
+			err = ferr.err
+		}
+
+		conn.Write([]byte(msg))
+
+		return err
+	}
+
+	if s.cache != nil {
+		s.cache.set(domain, []byte(text), negative)
+	}
+
+	s.writeResponse(conn, text)
 
 	return nil
 }
@@ -243,15 +408,54 @@ func mustParseRate(rate string) (r limiter.Rate) {
 func main() {
 	var headers headerFlags
 	flag.Var(&headers, "header", "Headers to add to the upstream HTTP request. May be used multiple times.")
+
+	var referralAllowList referralAllowListFlags
+	flag.Var(&referralAllowList, "referral-allow", "Host allowed to be contacted for a WHOIS referral, bypassing the private/loopback/link-local check below. May be used multiple times. Referrals to private, loopback, link-local, or unresolvable hosts are always rejected unless explicitly allow-listed here, since an upstream could otherwise use a referral to make us dial an internal address. Once any host is listed, referrals to hosts not listed are rejected.")
+
+	var routes routeFlags
+	flag.Var(&routes, "route", "Per-TLD (or regex) upstream override in the form <.tld-or-regex>=[rdap:|whois-http:]<upstream template>. May be used multiple times; -upstream/-protocol remain the fallback. The optional protocol prefix lets a route use a different protocol than the rest of the server.")
+
 	flag.Parse()
 
+	parsedUpstream := parseUpstreamOpt(*upstream)
+
+	proto := *protocol
+	if proto == "" {
+		proto = detectProtocol(parsedUpstream)
+	}
+
 	whois := WhoisServer{
-		upstream:      parseUpstreamOpt(*upstream),
-		acceptTimeout: 10 * time.Millisecond,
-		headers:       headers,
-		limiter:       limiter.New(memory.NewStore(), mustParseRate(*rate)),
-		stop:          make(chan bool),
-		done:          make(chan bool),
+		upstreamTemplate: *upstream,
+		protocol:         proto,
+		acceptTimeout:    10 * time.Millisecond,
+		headers:          headers,
+		limiter:          limiter.New(memory.NewStore(), mustParseRate(*rate)),
+		ipv4Prefix:       *ipv4Prefix,
+		ipv6Prefix:       *ipv6Prefix,
+		routes:           routes,
+		stop:             make(chan bool),
+		done:             make(chan bool),
+	}
+
+	if whois.protocol == protocolRDAP || whois.usesRDAPRoute() {
+		whois.rdapBootstrap = newRDAPBootstrapCache(&http.Client{}, time.Hour)
+	}
+
+	if *followReferrals {
+		whois.maxReferralHops = *maxReferralHops
+		whois.referralTimeout = *referralTimeout
+		whois.referralAllowList = referralAllowList
+	}
+
+	if *cfAccessClientID != "" || *cfAccessClientSecret != "" {
+		whois.cfAccess = newCFAccess(*cfAccessClientID, *cfAccessClientSecret, *cfAccessTokenURL)
+	}
+
+	if *cacheSize > 0 {
+		whois.cache = newResponseCache(*cacheSize, *cacheTTL, *cacheNegativeTTL)
+		whois.cacheChargeOnHit = *cacheChargeOnHit
+
+		go whois.cache.runSweeper(time.Minute, whois.stop)
 	}
 
 	go whois.Serve(mustListen(*listen))
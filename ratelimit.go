@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// rateLimitKey derives the rate-limit bucket key for remoteAddr, masking
+// the client IP down to ipv4Prefix (for IPv4, and IPv4-mapped IPv6) or
+// ipv6Prefix (for everything else) bits so that an abusive client can't
+// dodge the limit by rotating the untouched low bits of its address.
+func rateLimitKey(remoteAddr string, ipv4Prefix, ipv6Prefix int) (string, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to split host/port from remote addr %q: %w", remoteAddr, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("failed to parse ip from remote addr %q", remoteAddr)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(ipv4Prefix, 32)
+		return v4.Mask(mask).String(), nil
+	}
+
+	mask := net.CIDRMask(ipv6Prefix, 128)
+	return ip.Mask(mask).String(), nil
+}
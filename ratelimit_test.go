@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestRateLimitKeyIPv6(t *testing.T) {
+	a, err := rateLimitKey("[2001:db8::1]:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := rateLimitKey("[2001:db8::2]:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a != b {
+		t.Errorf("expected two IPv6 addresses in the same /64 to share a key, got %q and %q", a, b)
+	}
+}
+
+func TestRateLimitKeyIPv6PrefixAggregation(t *testing.T) {
+	sameBucket, err := rateLimitKey("[2001:db8:abcd:0012::1]:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alsoSameBucket, err := rateLimitKey("[2001:db8:abcd:0012:ffff:ffff:ffff:ffff]:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sameBucket != alsoSameBucket {
+		t.Errorf("expected addresses differing only past the /64 boundary to share a key, got %q and %q", sameBucket, alsoSameBucket)
+	}
+
+	differentBucket, err := rateLimitKey("[2001:db8:abcd:0013::1]:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sameBucket == differentBucket {
+		t.Errorf("expected a /64 rotation to produce a different key, got %q for both", sameBucket)
+	}
+}
+
+func TestRateLimitKeyIPv4MappedIPv6(t *testing.T) {
+	mapped, err := rateLimitKey("[::ffff:192.0.2.1]:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := rateLimitKey("192.0.2.1:5353", 32, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mapped != plain {
+		t.Errorf("expected an IPv4-mapped IPv6 address to key the same as its IPv4 form, got %q and %q", mapped, plain)
+	}
+}
+
+func TestRateLimitKeyIPv4PrefixAggregation(t *testing.T) {
+	a, err := rateLimitKey("192.0.2.1:5353", 24, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := rateLimitKey("192.0.2.254:9999", 24, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a != b {
+		t.Errorf("expected two IPv4 addresses in the same /24 to share a key, got %q and %q", a, b)
+	}
+
+	c, err := rateLimitKey("192.0.3.1:5353", 24, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == c {
+		t.Errorf("expected an address outside the /24 to produce a different key, got %q for both", a)
+	}
+}
+
+func TestRateLimitKeyInvalidRemoteAddr(t *testing.T) {
+	if _, err := rateLimitKey("not-a-valid-addr", 32, 64); err == nil {
+		t.Error("expected an error for a remote addr with no port")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ianaBootstrapURL = "https://data.iana.org/rdap/dns.json"
+
+// rdapBootstrap mirrors the subset of the IANA RDAP bootstrap registry
+// (https://data.iana.org/rdap/dns.json) that we need: a list of
+// [ [tlds...], [baseURLs...] ] services.
+type rdapBootstrap struct {
+	Services [][][]string `json:"services"`
+}
+
+// rdapBootstrapCache fetches and caches the IANA bootstrap registry so that
+// every lookup doesn't re-fetch it. It is safe for concurrent use.
+type rdapBootstrapCache struct {
+	mu      sync.Mutex
+	client  *http.Client
+	ttl     time.Duration
+	fetched time.Time
+	byTLD   map[string]string
+}
+
+func newRDAPBootstrapCache(client *http.Client, ttl time.Duration) *rdapBootstrapCache {
+	return &rdapBootstrapCache{client: client, ttl: ttl}
+}
+
+// baseURL returns the RDAP base URL registered for tld, fetching and
+// caching the bootstrap registry if necessary.
+func (c *rdapBootstrapCache) baseURL(tld string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byTLD == nil || time.Since(c.fetched) > c.ttl {
+		if err := c.refresh(); err != nil {
+			return "", err
+		}
+	}
+
+	base, ok := c.byTLD[strings.ToLower(tld)]
+	if !ok {
+		return "", fmt.Errorf("no RDAP service registered for tld; tld=%s", tld)
+	}
+
+	return base, nil
+}
+
+func (c *rdapBootstrapCache) refresh() error {
+	resp, err := c.client.Get(ianaBootstrapURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch RDAP bootstrap registry: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("RDAP bootstrap registry returned status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read RDAP bootstrap registry: %w", err)
+	}
+
+	var bootstrap rdapBootstrap
+	if err := json.Unmarshal(body, &bootstrap); err != nil {
+		return fmt.Errorf("failed to parse RDAP bootstrap registry: %w", err)
+	}
+
+	byTLD := make(map[string]string)
+	for _, service := range bootstrap.Services {
+		if len(service) != 2 || len(service[1]) == 0 {
+			continue
+		}
+
+		base := strings.TrimRight(service[1][0], "/")
+
+		for _, tld := range service[0] {
+			byTLD[strings.ToLower(tld)] = base
+		}
+	}
+
+	c.byTLD = byTLD
+	c.fetched = time.Now()
+
+	return nil
+}
+
+// rdapVCard is the subset of jCard (RFC 7095) fields we render.
+type rdapVCard struct {
+	FN    string
+	Email string
+	Tel   string
+}
+
+type rdapEntity struct {
+	Roles      []string        `json:"roles"`
+	VCardArray json.RawMessage `json:"vcardArray"`
+	Entities   []rdapEntity    `json:"entities"`
+}
+
+type rdapEvent struct {
+	Action string `json:"eventAction"`
+	Date   string `json:"eventDate"`
+}
+
+type rdapNameserver struct {
+	LDHName string `json:"ldhName"`
+}
+
+type rdapResponse struct {
+	Handle      string           `json:"handle"`
+	LDHName     string           `json:"ldhName"`
+	Status      []string         `json:"status"`
+	Entities    []rdapEntity     `json:"entities"`
+	Events      []rdapEvent      `json:"events"`
+	Nameservers []rdapNameserver `json:"nameservers"`
+
+	ErrorCode int `json:"errorCode"`
+}
+
+// vCard parses the jCard array into the fields we care about. The format is
+// ["vcard", [ ["fn", {}, "text", "Example Registrar"], ["email", {}, "text", "..."], ... ]]
+func (e rdapEntity) vCard() rdapVCard {
+	var card rdapVCard
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(e.VCardArray, &raw); err != nil || len(raw) < 2 {
+		return card
+	}
+
+	var props [][]json.RawMessage
+	if err := json.Unmarshal(raw[1], &props); err != nil {
+		return card
+	}
+
+	for _, prop := range props {
+		if len(prop) < 4 {
+			continue
+		}
+
+		var name string
+		if err := json.Unmarshal(prop[0], &name); err != nil {
+			continue
+		}
+
+		var value string
+		_ = json.Unmarshal(prop[3], &value)
+
+		switch name {
+		case "fn":
+			card.FN = value
+		case "email":
+			card.Email = value
+		case "tel":
+			card.Tel = value
+		}
+	}
+
+	return card
+}
+
+// renderRDAP turns an RDAP domain response into a WHOIS-style key/value text
+// block, matching the shape of output clients already expect.
+func renderRDAP(r rdapResponse) string {
+	var b strings.Builder
+
+	if r.LDHName != "" {
+		fmt.Fprintf(&b, "Domain Name: %s\r\n", r.LDHName)
+	}
+
+	if r.Handle != "" {
+		fmt.Fprintf(&b, "Registry Domain ID: %s\r\n", r.Handle)
+	}
+
+	for _, entity := range r.Entities {
+		card := entity.vCard()
+
+		role := "Registrant"
+		if len(entity.Roles) > 0 {
+			role = strings.Title(entity.Roles[0])
+		}
+
+		if card.FN != "" {
+			fmt.Fprintf(&b, "%s Name: %s\r\n", role, card.FN)
+		}
+		if card.Email != "" {
+			fmt.Fprintf(&b, "%s Email: %s\r\n", role, card.Email)
+		}
+		if card.Tel != "" {
+			fmt.Fprintf(&b, "%s Phone: %s\r\n", role, card.Tel)
+		}
+	}
+
+	for _, event := range r.Events {
+		fmt.Fprintf(&b, "%s: %s\r\n", rdapEventLabel(event.Action), event.Date)
+	}
+
+	for _, ns := range r.Nameservers {
+		fmt.Fprintf(&b, "Name Server: %s\r\n", ns.LDHName)
+	}
+
+	for _, status := range r.Status {
+		fmt.Fprintf(&b, "Domain Status: %s\r\n", status)
+	}
+
+	return b.String()
+}
+
+func rdapEventLabel(action string) string {
+	switch action {
+	case "registration":
+		return "Creation Date"
+	case "expiration":
+		return "Registry Expiry Date"
+	case "last changed":
+		return "Updated Date"
+	default:
+		return strings.Title(action)
+	}
+}
+
+// queryRDAP looks up domain against base (the routed/-upstream RDAP
+// template, used verbatim as a base URL) unless the IANA bootstrap
+// registry has a more specific entry for its TLD, and renders the result
+// as WHOIS-style text. A 404 is reported back as a normal "no match" result
+// rather than an error, matching how registries signal unregistered
+// domains over RDAP.
+func (s *WhoisServer) queryRDAP(domain string, base string) (text string, negative bool, err error) {
+	if s.rdapBootstrap != nil {
+		if tldBase, err := s.rdapBootstrap.baseURL(tldOf(domain)); err == nil {
+			base = tldBase
+		} else {
+			log.Printf("rdap bootstrap lookup failed, using default upstream; domain=%s, err=%v", domain, err)
+		}
+	}
+
+	reqURL := strings.TrimRight(base, "/") + "/domain/" + domain
+
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	req.Header.Set("Accept", "application/rdap+json")
+
+	for _, h := range s.headers {
+		if h.name == "Host" {
+			req.Host = h.value
+			continue
+		}
+		req.Header.Add(h.name, h.value)
+	}
+
+	resp, err := s.doUpstream(s.rdapClient(), req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "No match\r\n", true, nil
+	}
+
+	if resp.StatusCode != 200 {
+		return "", false, fmt.Errorf("RDAP response is not 200; code=%d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+
+	var parsed rdapResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", false, fmt.Errorf("failed to parse RDAP response: %w", err)
+	}
+
+	return renderRDAP(parsed), false, nil
+}
+
+func (s *WhoisServer) rdapClient() *http.Client {
+	return &http.Client{}
+}
+
+// tldOf returns the last label of domain, ignoring a trailing dot.
+func tldOf(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	idx := strings.LastIndex(domain, ".")
+	if idx == -1 {
+		return domain
+	}
+	return domain[idx+1:]
+}
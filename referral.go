@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var referralServerPattern = regexp.MustCompile(`(?im)^\s*(?:Registrar WHOIS Server|Whois Server|ReferralServer)\s*:\s*(\S+)\s*$`)
+
+// findReferral extracts a registrar WHOIS server from a thin-registry
+// response, stripping a whois:// scheme if present.
+func findReferral(body []byte) string {
+	m := referralServerPattern.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+
+	server := strings.TrimSpace(string(m[1]))
+	server = strings.TrimPrefix(server, "whois://")
+
+	return server
+}
+
+// queryWhois43 performs a raw WHOIS query against server (host or host:port,
+// defaulting to port 43) and returns the response body.
+func queryWhois43(server string, domain string, timeout time.Duration) ([]byte, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "43")
+	}
+
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial referral server %s: %w", server, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write([]byte(domain + "\r\n")); err != nil {
+		return nil, fmt.Errorf("failed to write query to referral server %s: %w", server, err)
+	}
+
+	body, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from referral server %s: %w", server, err)
+	}
+
+	return body, nil
+}
+
+// chaseReferrals follows "Registrar WHOIS Server:" style referrals found in
+// body, up to s.maxReferralHops times, honoring s.referralAllowList when it
+// is non-empty. It returns body with each followed referral's response
+// appended after a CRLF, which is body itself when no referral was found or
+// followed.
+func (s *WhoisServer) chaseReferrals(domain string, body []byte) []byte {
+	if s.maxReferralHops <= 0 {
+		return body
+	}
+
+	seen := make(map[string]bool)
+
+	// latest is only the most recently fetched response, which is what the
+	// next hop's referral (if any) must be found in; accumulated is what we
+	// hand back to the client.
+	accumulated := body
+	latest := body
+
+	for hop := 0; hop < s.maxReferralHops; hop++ {
+		server := findReferral(latest)
+		if server == "" {
+			break
+		}
+
+		if seen[server] {
+			log.Printf("referral loop detected, stopping; server=%s", server)
+			break
+		}
+		seen[server] = true
+
+		if !s.referralAllowed(server) {
+			log.Printf("referral server not in allow-list, skipping; server=%s", server)
+			break
+		}
+
+		log.Printf("following referral; domain=%s, server=%s, hop=%d", domain, server, hop+1)
+
+		referralBody, err := queryWhois43(server, domain, s.referralTimeout)
+		if err != nil {
+			log.Printf("referral query failed; server=%s, err=%v", server, err)
+			break
+		}
+
+		accumulated = append(append(append([]byte{}, accumulated...), []byte("\r\n")...), referralBody...)
+		latest = referralBody
+	}
+
+	return accumulated
+}
+
+// referralAllowed reports whether server may be contacted for a referral.
+// Explicitly allow-listing a host always permits it. When the allow-list is
+// non-empty, every host not on it is rejected. When it is empty, any server
+// is allowed except one that resolves to a private, loopback, link-local,
+// or unspecified address: without this, an upstream (or a thin registry it
+// forwards for) could hand back a "Registrar WHOIS Server:" line pointing
+// at an internal address and use us to pivot a raw TCP connection into the
+// local network.
+func (s *WhoisServer) referralAllowed(server string) bool {
+	host := server
+	if h, _, err := net.SplitHostPort(server); err == nil {
+		host = h
+	}
+
+	for _, allowed := range s.referralAllowList {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+
+	if len(s.referralAllowList) > 0 {
+		return false
+	}
+
+	if isPrivateReferralTarget(host) {
+		log.Printf("referral server resolves to a private/internal address, skipping; server=%s", server)
+		return false
+	}
+
+	return true
+}
+
+// isPrivateReferralTarget reports whether host (a hostname or IP literal)
+// resolves to a private, loopback, link-local, or unspecified address. A
+// lookup failure is treated as private, since we have no way to confirm it
+// isn't.
+func isPrivateReferralTarget(host string) bool {
+	ips := []net.IP{net.ParseIP(host)}
+
+	if ips[0] == nil {
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			log.Printf("failed to resolve referral host, treating as private; host=%s, err=%v", host, err)
+			return true
+		}
+		ips = resolved
+	}
+
+	for _, ip := range ips {
+		if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// referralAllowListFlags collects repeated -referral-allow flags.
+type referralAllowListFlags []string
+
+func (f *referralAllowListFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *referralAllowListFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// route pairs a TLD suffix (".jp") or arbitrary regex with the upstream
+// template to use when a query matches it, and optionally the protocol to
+// use for that route. An empty protocol means "inherit whatever -protocol
+// resolved to for the server as a whole", so a single deployment can front
+// RDAP for gTLDs while still sending a ccTLD that doesn't publish RDAP, or a
+// private corporate TLD, over the legacy whois-over-HTTP path.
+type route struct {
+	match    string
+	protocol string
+	template string
+	re       *regexp.Regexp
+}
+
+// routeFlags collects repeated -route <match>=[protocol:]<template> flags.
+type routeFlags []route
+
+func (f *routeFlags) String() string {
+	var flattened []string
+
+	for _, r := range *f {
+		template := r.template
+		if r.protocol != "" {
+			template = r.protocol + ":" + template
+		}
+
+		flattened = append(flattened, fmt.Sprintf("%s=%s", r.match, template))
+	}
+
+	return strings.Join(flattened, ",")
+}
+
+// routeProtocolPrefixes maps the optional "<protocol>:" prefix on a route's
+// template to the protocol it selects.
+var routeProtocolPrefixes = map[string]string{
+	protocolRDAP + ":":      protocolRDAP,
+	protocolWhoisHTTP + ":": protocolWhoisHTTP,
+}
+
+func (f *routeFlags) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid route %q, expected <match>=[protocol:]<upstream template>", v)
+	}
+
+	match, template := parts[0], parts[1]
+
+	var protocol string
+	for prefix, proto := range routeProtocolPrefixes {
+		if strings.HasPrefix(template, prefix) {
+			protocol = proto
+			template = strings.TrimPrefix(template, prefix)
+			break
+		}
+	}
+
+	var re *regexp.Regexp
+	var err error
+
+	if strings.HasPrefix(match, ".") {
+		re, err = regexp.Compile(regexp.QuoteMeta(match) + "$")
+	} else {
+		re, err = regexp.Compile(match)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid route match %q: %w", match, err)
+	}
+
+	*f = append(*f, route{match: match, protocol: protocol, template: template, re: re})
+
+	return nil
+}
+
+// resolveRoute returns the upstream template and protocol to use for
+// domain: the most specific matching route, or s.upstreamTemplate/s.protocol
+// when nothing matches. "Most specific" means the route whose match string
+// is the longest; among equally long matches, the one registered first
+// wins. A route registered without a "<protocol>:" prefix inherits the
+// server's global protocol.
+func (s *WhoisServer) resolveRoute(domain string) (template string, protocol string) {
+	tld := "." + tldOf(domain)
+
+	var best *route
+
+	for i := range s.routes {
+		r := &s.routes[i]
+
+		if !r.re.MatchString(tld) && !r.re.MatchString(domain) {
+			continue
+		}
+
+		if best == nil || len(r.match) > len(best.match) {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return s.upstreamTemplate, s.protocol
+	}
+
+	log.Printf("routing query; domain=%s, route=%s", domain, best.match)
+
+	protocol = best.protocol
+	if protocol == "" {
+		protocol = s.protocol
+	}
+
+	return best.template, protocol
+}
+
+// usesRDAPRoute reports whether any route opts into RDAP, regardless of the
+// server's global protocol.
+func (s *WhoisServer) usesRDAPRoute() bool {
+	for _, r := range s.routes {
+		if r.protocol == protocolRDAP {
+			return true
+		}
+	}
+
+	return false
+}